@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Op identifies the kind of access a request is attempting, so an
+// Authorizer can grant or deny it per prefix.
+type Op int
+
+const (
+	OpRead Op = iota
+	OpWrite
+	OpDelete
+	OpSubscribe
+	OpReserve
+	OpStats
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpRead:
+		return "read"
+	case OpWrite:
+		return "write"
+	case OpDelete:
+		return "delete"
+	case OpSubscribe:
+		return "subscribe"
+	case OpReserve:
+		return "reserve"
+	case OpStats:
+		return "stats"
+	default:
+		return "unknown"
+	}
+}
+
+// Authorizer decides whether a request may perform op against key,
+// returning the caller's identity (for logging and reservations) and
+// whether the request is allowed.
+type Authorizer interface {
+	Authorize(r *http.Request, op Op, key string) (identity string, ok bool)
+}
+
+// allowAll is the default Authorizer: it trusts every request, matching
+// atomkv's original wide-open behavior when no ACL config is supplied.
+type allowAll struct{}
+
+func (allowAll) Authorize(r *http.Request, op Op, key string) (string, bool) {
+	return "", true
+}
+
+// aclRule grants permissions on every key under Prefix.
+type aclRule struct {
+	Prefix      string   `json:"prefix"`
+	Permissions []string `json:"permissions"`
+}
+
+func (rule aclRule) allows(op Op) bool {
+	for _, perm := range rule.Permissions {
+		if perm == op.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// aclUser is one entry of the FileAuthorizer config: a bearer token or
+// HTTP Basic credential pair, together with the prefixes it may access.
+type aclUser struct {
+	Token    string    `json:"token"`
+	Username string    `json:"username"`
+	Password string    `json:"password"`
+	ACL      []aclRule `json:"acl"`
+}
+
+// FileAuthorizer is the built-in Authorizer: it loads a JSON array of
+// aclUser from a config file and checks each request's bearer token or
+// Basic credentials against the matching user's per-prefix permissions.
+type FileAuthorizer struct {
+	users []aclUser
+}
+
+// LoadFileAuthorizer reads and parses a FileAuthorizer config from path.
+func LoadFileAuthorizer(path string) (*FileAuthorizer, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var users []aclUser
+	if err := json.Unmarshal(buf, &users); err != nil {
+		return nil, err
+	}
+	return &FileAuthorizer{users: users}, nil
+}
+
+// secretEqual compares a and b in constant time, for credentials checked
+// against the server's own store where a timing difference could leak
+// how many leading bytes a guess got right.
+func secretEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, prefix) {
+		return auth[len(prefix):]
+	}
+	return ""
+}
+
+// identify resolves r's credentials to one of a.users, reporting the
+// identity to use for logging and reservations. Unrecognized or missing
+// credentials return ("", nil).
+func (a *FileAuthorizer) identify(r *http.Request) (string, *aclUser) {
+	if token := bearerToken(r); token != "" {
+		for i := range a.users {
+			if a.users[i].Token != "" && secretEqual(a.users[i].Token, token) {
+				return token, &a.users[i]
+			}
+		}
+		return "", nil
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		for i := range a.users {
+			if a.users[i].Username == username && secretEqual(a.users[i].Password, password) {
+				return username, &a.users[i]
+			}
+		}
+	}
+	return "", nil
+}
+
+func (a *FileAuthorizer) Authorize(r *http.Request, op Op, key string) (string, bool) {
+	identity, user := a.identify(r)
+	if user == nil {
+		return "", false
+	}
+	for _, rule := range user.ACL {
+		if strings.HasPrefix(key, rule.Prefix) && rule.allows(op) {
+			return identity, true
+		}
+	}
+	return identity, false
+}
@@ -2,24 +2,36 @@ package main
 
 import (
 	"context"
+	"log"
+	"os"
 	"strings"
 	"time"
 )
 
 const (
-	defaultBuflen = 64
-	defaultExpiry = time.Hour * 24 * 7
+	defaultBuflen  = 64
+	defaultExpiry  = time.Hour * 24 * 7
+	defaultHistory = 256
 )
 
+// ttlNever is the entry.ttl sentinel meaning "this key never expires",
+// set via SetTTL or the X-TTL: never header.
+const ttlNever time.Duration = -1
+
 type Update struct {
-	Key      string
-	Value    string
-	Revision int
+	Key       string
+	Value     string
+	Revision  int
+	GlobalRev int64
+	TTL       time.Duration
+	Deleted   bool
 }
 
 type entry struct {
 	value    string
 	revision int
+	ttl      time.Duration // 0 = d.expiry, ttlNever = pinned, else explicit
+	written  time.Time
 }
 
 type requestGet struct {
@@ -34,24 +46,76 @@ type requestGet struct {
 type requestSet struct {
 	key   string
 	value string
+	ttl   *time.Duration // nil keeps the key's existing/default TTL
 }
 
 type requestUpdate struct {
 	key      string
 	value    string
 	revision int
+	ttl      *time.Duration // nil keeps the key's existing/default TTL
 	resp     chan<- bool
 }
 
+type requestDelete struct {
+	key         string
+	revision    int
+	conditional bool
+	resp        chan<- bool
+}
+
+type requestRange struct {
+	prefix string
+	resp   chan<- map[string]RangeEntry
+}
+
+// RangeEntry is the value, revision, and TTL override of a single key
+// returned by Range. Written is only populated in the on-disk snapshot
+// (see compact): it's the entry's last-write time as UnixNano, needed to
+// correctly resume a TTL countdown across a restart instead of resetting
+// it to the snapshot file's own mtime.
+type RangeEntry struct {
+	Value    string
+	Revision int
+	TTL      time.Duration
+	Written  int64
+}
+
 type requestSubscribe struct {
-	path string
-	ch   chan Update
+	path    string
+	ch      chan Update
+	fromRev int64
 }
 
 type requestUnsubscribe struct {
 	ch <-chan Update
 }
 
+type requestReserve struct {
+	prefix   string
+	identity string
+	resp     chan<- bool
+}
+
+type requestReservationOwner struct {
+	key  string
+	resp chan<- string
+}
+
+type requestSetTTL struct {
+	key  string
+	ttl  time.Duration
+	resp chan<- bool
+}
+
+type requestExpiresAt struct {
+	key  string
+	resp chan<- struct {
+		t  time.Time
+		ok bool
+	}
+}
+
 type subscriber struct {
 	path string
 	ch   chan Update
@@ -63,23 +127,47 @@ type Database struct {
 	subscribers   map[<-chan Update]subscriber
 	buflen        int
 	expiry        time.Duration
-
-	chGet         chan requestGet
-	chSet         chan requestSet
-	chUpdate      chan requestUpdate
-	chDelete      chan string
-	chSubscribe   chan requestSubscribe
-	chUnsubscribe chan requestUnsubscribe
-	chStop        chan struct{}
+	historyLen    int
+	globalRev     int64
+	history       []Update
+
+	persistPath string
+	fsyncPolicy FsyncPolicy
+	logFile     *os.File
+	logSize     int64
+
+	reservations map[string]string // prefix -> identity holding exclusive write access
+
+	chGet              chan requestGet
+	chSet              chan requestSet
+	chUpdate           chan requestUpdate
+	chDelete           chan requestDelete
+	chRange            chan requestRange
+	chSubscribe        chan requestSubscribe
+	chUnsubscribe      chan requestUnsubscribe
+	chReserve          chan requestReserve
+	chReservationOwner chan requestReservationOwner
+	chSetTTL           chan requestSetTTL
+	chExpiresAt        chan requestExpiresAt
+	chCompact          chan struct{}
+	chFsync            chan struct{}
+	chStop             chan struct{}
 }
 
-func NewDatabase(buflen int, expiry time.Duration) *Database {
+// NewDatabase constructs a Database. buflen, expiry, and historyLen fall
+// back to their defaults when given as zero. When path is non-empty, the
+// database loads its prior state from "<path>.snapshot"/"<path>.log" and
+// persists subsequent mutations there; see openPersistence.
+func NewDatabase(buflen int, expiry time.Duration, historyLen int, path string, fsync FsyncPolicy) *Database {
 	if buflen == 0 {
 		buflen = defaultBuflen
 	}
 	if expiry == 0 {
 		expiry = defaultExpiry
 	}
+	if historyLen == 0 {
+		historyLen = defaultHistory
+	}
 
 	database := Database{
 		values:        make(map[string]entry),
@@ -87,15 +175,31 @@ func NewDatabase(buflen int, expiry time.Duration) *Database {
 		subscribers:   make(map[<-chan Update]subscriber),
 		buflen:        buflen,
 		expiry:        expiry,
+		historyLen:    historyLen,
+		reservations:  make(map[string]string),
+
+		chGet:              make(chan requestGet),
+		chSet:              make(chan requestSet),
+		chUpdate:           make(chan requestUpdate),
+		chDelete:           make(chan requestDelete),
+		chRange:            make(chan requestRange),
+		chSubscribe:        make(chan requestSubscribe),
+		chUnsubscribe:      make(chan requestUnsubscribe),
+		chReserve:          make(chan requestReserve),
+		chReservationOwner: make(chan requestReservationOwner),
+		chSetTTL:           make(chan requestSetTTL),
+		chExpiresAt:        make(chan requestExpiresAt),
+		chCompact:          make(chan struct{}),
+		chFsync:            make(chan struct{}),
+		chStop:             make(chan struct{}),
+	}
 
-		chGet:         make(chan requestGet),
-		chSet:         make(chan requestSet),
-		chUpdate:      make(chan requestUpdate),
-		chDelete:      make(chan string),
-		chSubscribe:   make(chan requestSubscribe),
-		chUnsubscribe: make(chan requestUnsubscribe),
-		chStop:        make(chan struct{}),
+	if path != "" {
+		if err := database.openPersistence(path, fsync); err != nil {
+			log.Printf("atomkv: persistence disabled: %v", err)
+		}
 	}
+
 	go database.dispatch()
 	return &database
 }
@@ -111,15 +215,35 @@ func (d *Database) dispatch() {
 				ok       bool
 			}{e.value, e.revision, ok}
 		case r := <-d.chSet:
-			d.set(r.key, r.value)
+			d.set(r.key, r.value, r.ttl)
 		case r := <-d.chUpdate:
-			r.resp <- d.update(r.key, r.value, r.revision)
-		case key := <-d.chDelete:
-			delete(d.values, key)
+			r.resp <- d.update(r.key, r.value, r.revision, r.ttl)
+		case r := <-d.chDelete:
+			r.resp <- d.delete(r.key, r.revision, r.conditional)
+		case r := <-d.chRange:
+			r.resp <- d.rangeQuery(r.prefix)
 		case r := <-d.chSubscribe:
-			d.subscribe(r.path, r.ch)
+			d.subscribe(r.path, r.ch, r.fromRev)
 		case r := <-d.chUnsubscribe:
 			d.unsubscribe(r.ch)
+		case r := <-d.chReserve:
+			r.resp <- d.reserve(r.prefix, r.identity)
+		case r := <-d.chReservationOwner:
+			r.resp <- d.reservationOwner(r.key)
+		case r := <-d.chSetTTL:
+			r.resp <- d.setTTL(r.key, r.ttl)
+		case r := <-d.chExpiresAt:
+			t, ok := d.expiresAt(r.key)
+			r.resp <- struct {
+				t  time.Time
+				ok bool
+			}{t, ok}
+		case <-d.chCompact:
+			d.compact()
+		case <-d.chFsync:
+			if d.logFile != nil {
+				d.logFile.Sync()
+			}
 		case <-d.chStop:
 			return
 		}
@@ -131,52 +255,163 @@ func (d *Database) get(key string) (entry, bool) {
 	return e, ok
 }
 
-func (d *Database) set(key string, value string) {
+// set stores value under key. When ttl is non-nil it overrides the key's
+// TTL as part of this same write, so a newly created key's expire
+// goroutine arms with the right duration from the start instead of
+// racing a follow-up SetTTL call.
+func (d *Database) set(key string, value string, ttl *time.Duration) {
 	e, ok := d.values[key]
 	if ok {
 		e.revision++
-	} else {
-		go d.expire(key)
+	}
+	if ttl != nil {
+		e.ttl = *ttl
 	}
 	e.value = value
+	e.written = time.Now()
 	d.values[key] = e
-	d.notify(key, e)
+	if !ok {
+		go d.expireAfter(key, d.armDuration(e.ttl))
+	}
+	d.appendLog(logRecord{Op: opSet, Key: key, Value: value, Revision: e.revision, TTL: int64(e.ttl), Time: e.written.UnixNano()})
+	d.notify(Update{Key: key, Value: e.value, Revision: e.revision, TTL: e.ttl})
 }
 
-func (d *Database) update(key string, value string, revision int) bool {
-	e, ok := d.values[key]
+func (d *Database) update(key string, value string, revision int, ttl *time.Duration) bool {
+	prev, ok := d.values[key]
 	if !ok {
-		e.revision = -1
+		prev.revision = -1
 	}
-	if e.revision+1 != revision {
+	if prev.revision+1 != revision {
 		return false
 	}
+	e := entry{value: value, revision: revision, ttl: prev.ttl, written: time.Now()}
+	if ttl != nil {
+		e.ttl = *ttl
+	}
+	d.values[key] = e
+	if !ok {
+		go d.expireAfter(key, d.armDuration(e.ttl))
+	}
+	d.appendLog(logRecord{Op: opUpdate, Key: key, Value: value, Revision: e.revision, TTL: int64(e.ttl), Time: e.written.UnixNano()})
+	d.notify(Update{Key: key, Value: e.value, Revision: e.revision, TTL: e.ttl})
+	return true
+}
+
+// setTTL changes key's time-to-live without touching its value, and
+// touches it so any running expire goroutine picks up the new TTL
+// immediately instead of on the next write.
+func (d *Database) setTTL(key string, ttl time.Duration) bool {
+	e, ok := d.values[key]
 	if !ok {
-		go d.expire(key)
+		return false
 	}
-	e = entry{value, revision}
+	e.ttl = ttl
+	e.written = time.Now()
 	d.values[key] = e
-	d.notify(key, e)
+	d.appendLog(logRecord{Op: opTTL, Key: key, Revision: e.revision, TTL: int64(ttl), Time: e.written.UnixNano()})
+	d.notify(Update{Key: key, Value: e.value, Revision: e.revision, TTL: e.ttl})
 	return true
 }
 
-func (d *Database) expire(key string) {
-	t := time.NewTimer(d.expiry)
+// expiresAt reports when key's current TTL will lapse. The zero Time
+// means key is pinned to never expire. ok is false if key doesn't exist.
+func (d *Database) expiresAt(key string) (time.Time, bool) {
+	e, ok := d.values[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	if e.ttl == ttlNever {
+		return time.Time{}, true
+	}
+	return e.written.Add(d.armDuration(e.ttl)), true
+}
+
+// armDuration resolves a per-key TTL override (0 = d.expiry, ttlNever =
+// pinned) to a concrete timer duration.
+func (d *Database) armDuration(ttl time.Duration) time.Duration {
+	switch ttl {
+	case ttlNever:
+		return 1<<63 - 1 // effectively forever; a touch will reset it
+	case 0:
+		return d.expiry
+	default:
+		return ttl
+	}
+}
+
+func (d *Database) delete(key string, revision int, conditional bool) bool {
+	e, existed := d.values[key]
+	if conditional && (!existed || e.revision != revision) {
+		return false
+	}
+	delete(d.values, key)
+	d.appendLog(logRecord{Op: opDelete, Key: key, Time: time.Now().UnixNano()})
+	if existed {
+		// Tombstone: Value is the JSON literal null, so watchers (and
+		// a resuming Watch's history replay) learn the key is gone
+		// instead of never hearing about the delete at all.
+		d.notify(Update{Key: key, Value: "null", Revision: e.revision, Deleted: true})
+	}
+	return true
+}
+
+func (d *Database) rangeQuery(prefix string) map[string]RangeEntry {
+	result := make(map[string]RangeEntry)
+	for key, e := range d.values {
+		if strings.HasPrefix(key, prefix) {
+			result[key] = RangeEntry{Value: e.value, Revision: e.revision, TTL: e.ttl}
+		}
+	}
+	return result
+}
+
+// expireAfter arms a key's expire timer with an initial wait (the key's
+// resolved TTL for a brand new key, or whatever's left of it on persistence
+// replay) and re-arms it on every subsequent write using that write's own
+// TTL, so a per-key override (via SetTTL or X-TTL) takes effect
+// immediately instead of on the next write.
+func (d *Database) expireAfter(key string, wait time.Duration) {
+	if wait < 0 {
+		wait = 0
+	}
+	t := time.NewTimer(wait)
 	ch := d.Subscribe(key)
 	for {
 		select {
-		case <-ch:
+		case u, ok := <-ch:
+			if !ok {
+				return
+			}
+			if u.Deleted {
+				// Key is gone for good; stop watching it instead
+				// of re-arming a timer for a key nothing will
+				// ever write to again.
+				d.Unsubscribe(ch)
+				return
+			}
 			if !t.Stop() {
 				<-t.C
 			}
-			t.Reset(d.expiry)
+			t.Reset(d.armDuration(u.TTL))
 		case <-t.C:
 			d.Delete(key)
 		}
 	}
 }
 
-func (d *Database) subscribe(path string, ch chan Update) {
+func (d *Database) subscribe(path string, ch chan Update, fromRev int64) {
+	if fromRev > 0 {
+		for _, u := range d.history {
+			if u.GlobalRev > fromRev && pathMatches(path, u.Key) {
+				select {
+				case ch <- u:
+				default: // drop, same as a live subscriber falling behind
+				}
+			}
+		}
+	}
+
 	m, ok := d.subscriptions[path]
 	if !ok {
 		m = make(map[chan Update]struct{})
@@ -196,16 +431,68 @@ func (d *Database) unsubscribe(ch <-chan Update) {
 	}
 }
 
-func (d *Database) notify(key string, e entry) {
+// reserve claims prefix for identity, reporting false if another identity
+// already holds it. A successful reservation persists alongside the
+// database and disconnects any subscriber it no longer trusts.
+func (d *Database) reserve(prefix, identity string) bool {
+	if owner, ok := d.reservations[prefix]; ok && owner != identity {
+		return false
+	}
+	d.reservations[prefix] = identity
+	d.persistReservations()
+	d.terminateReservedSubscribers(prefix)
+	return true
+}
+
+// reservationOwner returns the identity holding the longest reserved
+// prefix covering key, or "" if key isn't under any reservation.
+func (d *Database) reservationOwner(key string) string {
+	var owner, longest string
+	for prefix, identity := range d.reservations {
+		if strings.HasPrefix(key, prefix) && len(prefix) >= len(longest) {
+			owner, longest = identity, prefix
+		}
+	}
+	return owner
+}
+
+// terminateReservedSubscribers drops and closes the channel of every
+// subscriber whose path falls under prefix, so an SSE client watching a
+// topic that just changed hands gets disconnected rather than kept
+// trusting stale access.
+func (d *Database) terminateReservedSubscribers(prefix string) {
+	for ch, sub := range d.subscribers {
+		if !strings.HasPrefix(sub.path, prefix) {
+			continue
+		}
+		delete(d.subscribers, ch)
+		m := d.subscriptions[sub.path]
+		delete(m, sub.ch)
+		if len(m) == 0 {
+			delete(d.subscriptions, sub.path)
+		}
+		close(sub.ch)
+	}
+}
+
+// notify appends u to the history ring and delivers it to every
+// subscriber covering u.Key, stamping u.GlobalRev along the way. Callers
+// build u themselves: set/update/setTTL copy the entry's current state,
+// while delete synthesizes a tombstone (Deleted, Value "null").
+func (d *Database) notify(u Update) {
+	d.globalRev++
+	u.GlobalRev = d.globalRev
+	d.record(u)
+
 	seen := make(map[chan Update]struct{})
-	part := key
+	part := u.Key
 	for {
 		if m, ok := d.subscriptions[part]; ok {
 			for s := range m {
 				if _, ok := seen[s]; !ok {
 					seen[s] = struct{}{}
 					select {
-					case s <- Update{Key: key, Value: e.value, Revision: e.revision}:
+					case s <- u:
 					default: // drop
 					}
 				}
@@ -219,6 +506,25 @@ func (d *Database) notify(key string, e entry) {
 	}
 }
 
+// record appends u to the bounded history ring used to replay missed
+// updates to resuming watchers, discarding the oldest entry once
+// historyLen is exceeded.
+func (d *Database) record(u Update) {
+	d.history = append(d.history, u)
+	if len(d.history) > d.historyLen {
+		d.history = d.history[len(d.history)-d.historyLen:]
+	}
+}
+
+// pathMatches reports whether a subscription on path would receive
+// updates for key, mirroring the ancestor walk in notify.
+func pathMatches(path, key string) bool {
+	if path == key {
+		return true
+	}
+	return strings.HasSuffix(path, "/") && strings.HasPrefix(key, path)
+}
+
 func validate(key string) {
 	if len(key) == 0 || key[0] != '/' {
 		panic("invalid key")
@@ -242,6 +548,16 @@ func (d *Database) Set(key string, value string) {
 	d.chSet <- requestSet{key: key, value: value}
 }
 
+// SetWithTTL is like Set, but also applies ttl to the key as part of the
+// same write. Prefer this over Set followed by SetTTL when creating a
+// key with a non-default TTL: a separate SetTTL call could otherwise
+// race the key's own expire goroutine, which only picks up a TTL change
+// once it's finished subscribing.
+func (d *Database) SetWithTTL(key string, value string, ttl time.Duration) {
+	validate(key)
+	d.chSet <- requestSet{key: key, value: value, ttl: &ttl}
+}
+
 func (d *Database) Update(key string, value string, revision int) bool {
 	validate(key)
 	resp := make(chan bool)
@@ -254,8 +570,44 @@ func (d *Database) Update(key string, value string, revision int) bool {
 	return <-resp
 }
 
+// UpdateWithTTL is like Update, but also applies ttl to the key as part
+// of the same write; see SetWithTTL for why that matters.
+func (d *Database) UpdateWithTTL(key string, value string, revision int, ttl time.Duration) bool {
+	validate(key)
+	resp := make(chan bool)
+	d.chUpdate <- requestUpdate{
+		key:      key,
+		value:    value,
+		revision: revision,
+		ttl:      &ttl,
+		resp:     resp,
+	}
+	return <-resp
+}
+
 func (d *Database) Delete(key string) {
-	d.chDelete <- key
+	validate(key)
+	resp := make(chan bool)
+	d.chDelete <- requestDelete{key: key, resp: resp}
+	<-resp
+}
+
+// DeleteRevision removes key only if its current revision matches revision,
+// mirroring Update's compare-and-swap semantics. It reports whether the
+// delete happened.
+func (d *Database) DeleteRevision(key string, revision int) bool {
+	validate(key)
+	resp := make(chan bool)
+	d.chDelete <- requestDelete{key: key, revision: revision, conditional: true, resp: resp}
+	return <-resp
+}
+
+// Range returns every key currently stored under prefix along with its
+// value and revision.
+func (d *Database) Range(prefix string) map[string]RangeEntry {
+	resp := make(chan map[string]RangeEntry)
+	d.chRange <- requestRange{prefix: prefix, resp: resp}
+	return <-resp
 }
 
 func (d *Database) Subscribe(path string) <-chan Update {
@@ -265,10 +617,63 @@ func (d *Database) Subscribe(path string) <-chan Update {
 	return ch
 }
 
+// Watch is like Subscribe, but first replays every retained Update with a
+// GlobalRev greater than fromRev before joining the live tail, letting a
+// reconnecting client catch up on whatever it missed while disconnected.
+// The replay goes into the channel's buffer (buflen) without blocking:
+// retained Updates beyond what fits are dropped, not delivered.
+func (d *Database) Watch(path string, fromRev int64) <-chan Update {
+	validate(path)
+	ch := make(chan Update, d.buflen)
+	d.chSubscribe <- requestSubscribe{path: path, ch: ch, fromRev: fromRev}
+	return ch
+}
+
 func (d *Database) Unsubscribe(ch <-chan Update) {
 	d.chUnsubscribe <- requestUnsubscribe{ch: ch}
 }
 
+// Reserve claims exclusive write access to prefix for identity, mirroring
+// ntfy's topic reservations. It reports false if prefix is already
+// reserved by a different identity.
+func (d *Database) Reserve(prefix, identity string) bool {
+	resp := make(chan bool)
+	d.chReserve <- requestReserve{prefix: prefix, identity: identity, resp: resp}
+	return <-resp
+}
+
+// ReservationOwner returns the identity holding the reservation covering
+// key, or "" if key isn't under any reservation.
+func (d *Database) ReservationOwner(key string) string {
+	resp := make(chan string)
+	d.chReservationOwner <- requestReservationOwner{key: key, resp: resp}
+	return <-resp
+}
+
+// SetTTL changes key's time-to-live without touching its value or
+// revision, for callers who want to extend or shorten an existing key's
+// lifetime (e.g. refreshing a presence key's heartbeat). Pass ttlNever to
+// pin key so it never expires. It reports whether key existed.
+func (d *Database) SetTTL(key string, ttl time.Duration) bool {
+	validate(key)
+	resp := make(chan bool)
+	d.chSetTTL <- requestSetTTL{key: key, ttl: ttl, resp: resp}
+	return <-resp
+}
+
+// ExpiresAt returns the time key's current TTL will lapse. The zero Time
+// means key is pinned to never expire. ok is false if key doesn't exist.
+func (d *Database) ExpiresAt(key string) (time.Time, bool) {
+	validate(key)
+	resp := make(chan struct {
+		t  time.Time
+		ok bool
+	})
+	d.chExpiresAt <- requestExpiresAt{key: key, resp: resp}
+	r := <-resp
+	return r.t, r.ok
+}
+
 func (d *Database) Close() {
 	close(d.chStop)
 }
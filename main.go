@@ -11,10 +11,38 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 	"unicode"
 )
 
-type handler struct{}
+type handler struct {
+	authz   Authorizer
+	limiter *RateLimiter
+}
+
+// clientIP extracts the caller's address from r.RemoteAddr, stripping the
+// port added by net/http, for use as a rate-limiting key.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimited writes a 429 when ok is false, with a Retry-After header
+// only if wait is positive, and reports whether it did so.
+func rateLimited(w http.ResponseWriter, ok bool, wait time.Duration) bool {
+	if ok {
+		return false
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+0.999)))
+	}
+	http.Error(w, "rate limit exceeded", 429)
+	return true
+}
 
 func validKey(key string) bool {
 	if len(key) < 2 || key[0] != '/' {
@@ -43,17 +71,95 @@ func validPath(path string) bool {
 	return validKey(path)
 }
 
+const reservePrefix = "/_reserve"
+
+// authorize checks r against h.authz for op on key, writing the
+// appropriate error response and returning ok=false if the request
+// should go no further. A blank identity means no credentials were
+// recognized at all (401); a recognized identity lacking the permission
+// gets 403.
+func (h *handler) authorize(w http.ResponseWriter, r *http.Request, op Op, key string) (identity string, ok bool) {
+	identity, ok = h.authz.Authorize(r, op, key)
+	if !ok {
+		if identity == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer`)
+			http.Error(w, "unauthorized", 401)
+		} else {
+			http.Error(w, "forbidden", 403)
+		}
+		return "", false
+	}
+	return identity, true
+}
+
+// reserved reports whether key is reserved by someone other than
+// identity, writing a 403 if so.
+func reserved(w http.ResponseWriter, db *Database, key, identity string) bool {
+	if owner := db.ReservationOwner(key); owner != "" && owner != identity {
+		http.Error(w, "prefix reserved", 403)
+		return true
+	}
+	return false
+}
+
+func (h *handler) reserve(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.TrimPrefix(r.URL.Path, reservePrefix)
+	log.Printf("RESERVE %s %s", r.RemoteAddr, prefix)
+	if !validPath(prefix) {
+		http.Error(w, "invalid prefix", 400)
+		return
+	}
+
+	identity, ok := h.authorize(w, r, OpReserve, prefix)
+	if !ok {
+		return
+	}
+	if ok, wait := h.limiter.AllowWrite(clientIP(r), prefix); rateLimited(w, ok, wait) {
+		return
+	}
+
+	db, _ := FromContext(r.Context())
+	if !db.Reserve(prefix, identity) {
+		http.Error(w, "prefix already reserved", 409)
+		return
+	}
+}
+
+// stats reports the rate limiter's live counters. These leak every
+// connected client's IP and the key paths being watched, so unlike a
+// plain GET this requires OpStats rather than being open to anyone who
+// can reach the server.
+func (h *handler) stats(w http.ResponseWriter, r *http.Request) {
+	log.Printf("STATS %s", r.RemoteAddr)
+	if _, ok := h.authorize(w, r, OpStats, "/_stats"); !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.limiter.Stats())
+}
+
 func (h *handler) get(w http.ResponseWriter, r *http.Request) {
 	hdr := w.Header()
 	hdr.Set("Cache-Control", "no-cache")
 	hdr.Set("Content-Type", "application/json")
 
 	key := r.URL.Path
+	if key[len(key)-1] == '/' {
+		h.list(w, r)
+		return
+	}
+
 	log.Printf("GET %s %s", r.RemoteAddr, key)
 	if !validKey(key) {
 		http.Error(w, "invalid key", 400)
 		return
 	}
+	if _, ok := h.authorize(w, r, OpRead, key); !ok {
+		return
+	}
+	if ok, wait := h.limiter.AllowRead(clientIP(r)); rateLimited(w, ok, wait) {
+		return
+	}
 
 	db, _ := FromContext(r.Context())
 	value, revision, ok := db.Get(key)
@@ -62,9 +168,71 @@ func (h *handler) get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	hdr.Set("X-Revision", strconv.Itoa(revision))
+	if expiresAt, ok := db.ExpiresAt(key); ok {
+		if expiresAt.IsZero() {
+			hdr.Set("X-Expires-At", "never")
+		} else {
+			hdr.Set("X-Expires-At", expiresAt.UTC().Format(time.RFC3339))
+		}
+	}
 	io.WriteString(w, value)
 }
 
+func (h *handler) list(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	prefix := r.URL.Path
+	log.Printf("LIST %s %s", r.RemoteAddr, prefix)
+	if !validPath(prefix) {
+		http.Error(w, "invalid prefix", 400)
+		return
+	}
+	if _, ok := h.authorize(w, r, OpRead, prefix); !ok {
+		return
+	}
+	if ok, wait := h.limiter.AllowRead(clientIP(r)); rateLimited(w, ok, wait) {
+		return
+	}
+
+	db, _ := FromContext(r.Context())
+	entries := db.Range(prefix)
+	listing := make(map[string]struct {
+		Value    json.RawMessage `json:"value"`
+		Revision int             `json:"revision"`
+	}, len(entries))
+	for key, e := range entries {
+		listing[key] = struct {
+			Value    json.RawMessage `json:"value"`
+			Revision int             `json:"revision"`
+		}{json.RawMessage(e.Value), e.Revision}
+	}
+	json.NewEncoder(w).Encode(listing)
+}
+
+// parseTTL parses the X-TTL header: "never", or a count of seconds. A
+// count of 0 selects the database's default expiry, not an immediate one.
+func parseTTL(s string) (time.Duration, bool) {
+	if s == "never" {
+		return ttlNever, true
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// parseTTLHeader reads and parses the X-TTL header from r, if present.
+// present is false (with ok true) when the header was simply absent.
+func parseTTLHeader(r *http.Request) (ttl time.Duration, present bool, ok bool) {
+	hdr := r.Header.Get("X-TTL")
+	if hdr == "" {
+		return 0, false, true
+	}
+	ttl, ok = parseTTL(hdr)
+	return ttl, true, ok
+}
+
 func normalize(r io.Reader) (string, bool) {
 	buf, err := ioutil.ReadAll(r)
 	if err != nil {
@@ -88,14 +256,35 @@ func (h *handler) post(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid key", 400)
 		return
 	}
+	identity, ok := h.authorize(w, r, OpWrite, key)
+	if !ok {
+		return
+	}
+	if ok, wait := h.limiter.AllowWrite(clientIP(r), key); rateLimited(w, ok, wait) {
+		return
+	}
+
+	db, _ := FromContext(r.Context())
+	if reserved(w, db, key, identity) {
+		return
+	}
+
+	ttl, hasTTL, ok := parseTTLHeader(r)
+	if !ok {
+		http.Error(w, "invalid X-TTL", 400)
+		return
+	}
 
 	value, ok := normalize(r.Body)
 	if !ok {
 		http.Error(w, "invalid JSON", 400)
 		return
 	}
-	db, _ := FromContext(r.Context())
-	db.Set(key, value)
+	if hasTTL {
+		db.SetWithTTL(key, value, ttl)
+	} else {
+		db.Set(key, value)
+	}
 }
 
 func (h *handler) put(w http.ResponseWriter, r *http.Request) {
@@ -107,6 +296,18 @@ func (h *handler) put(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid key", 400)
 		return
 	}
+	identity, ok := h.authorize(w, r, OpWrite, key)
+	if !ok {
+		return
+	}
+	if ok, wait := h.limiter.AllowWrite(clientIP(r), key); rateLimited(w, ok, wait) {
+		return
+	}
+
+	db, _ := FromContext(r.Context())
+	if reserved(w, db, key, identity) {
+		return
+	}
 
 	xrevision := r.Header.Get("X-Revision")
 	if xrevision == "" {
@@ -119,14 +320,100 @@ func (h *handler) put(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ttl, hasTTL, ok := parseTTLHeader(r)
+	if !ok {
+		http.Error(w, "invalid X-TTL", 400)
+		return
+	}
+
 	json, ok := normalize(r.Body)
 	if !ok {
 		http.Error(w, "invalid JSON", 400)
 		return
 	}
 
+	var updated bool
+	if hasTTL {
+		updated = db.UpdateWithTTL(key, json, revision, ttl)
+	} else {
+		updated = db.Update(key, json, revision)
+	}
+	if !updated {
+		http.Error(w, "revision conflict", 409)
+		return
+	}
+}
+
+// patch retouches a key's X-TTL without writing a new value or bumping
+// its revision, for callers like a presence key's heartbeat that only
+// want to extend, shorten, or pin an existing key's lifetime.
+func (h *handler) patch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	key := r.URL.Path
+	log.Printf("PATCH %s %s", r.RemoteAddr, key)
+	if !validKey(key) {
+		http.Error(w, "invalid key", 400)
+		return
+	}
+	identity, ok := h.authorize(w, r, OpWrite, key)
+	if !ok {
+		return
+	}
+	if ok, wait := h.limiter.AllowWrite(clientIP(r), key); rateLimited(w, ok, wait) {
+		return
+	}
+
 	db, _ := FromContext(r.Context())
-	if !db.Update(key, json, revision) {
+	if reserved(w, db, key, identity) {
+		return
+	}
+
+	ttl, hasTTL, ok := parseTTLHeader(r)
+	if !ok || !hasTTL {
+		http.Error(w, "missing or invalid X-TTL", 400)
+		return
+	}
+	if !db.SetTTL(key, ttl) {
+		http.Error(w, "no such key", 404)
+		return
+	}
+}
+
+func (h *handler) delete(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	key := r.URL.Path
+	log.Printf("DELETE %s %s", r.RemoteAddr, key)
+	if !validKey(key) {
+		http.Error(w, "invalid key", 400)
+		return
+	}
+	identity, ok := h.authorize(w, r, OpDelete, key)
+	if !ok {
+		return
+	}
+	if ok, wait := h.limiter.AllowWrite(clientIP(r), key); rateLimited(w, ok, wait) {
+		return
+	}
+
+	db, _ := FromContext(r.Context())
+	if reserved(w, db, key, identity) {
+		return
+	}
+
+	xrevision := r.Header.Get("X-Revision")
+	if xrevision == "" {
+		db.Delete(key)
+		return
+	}
+
+	revision, err := strconv.Atoi(xrevision)
+	if err != nil {
+		http.Error(w, "invalid revision", 400)
+		return
+	}
+	if !db.DeleteRevision(key, revision) {
 		http.Error(w, "revision conflict", 409)
 		return
 	}
@@ -151,15 +438,34 @@ func (h *handler) events(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid path/key", 400)
 		return
 	}
+	if _, ok := h.authorize(w, r, OpSubscribe, path); !ok {
+		return
+	}
+	ip := clientIP(r)
+	if ok, wait := h.limiter.AcquireSubscribe(ip, path); !ok {
+		rateLimited(w, ok, wait)
+		return
+	}
+	defer h.limiter.ReleaseSubscribe(ip, path)
 
 	ctx := r.Context()
 	db, _ := FromContext(r.Context())
-	ch := db.Subscribe(path)
+
+	fromRev := lastEventGlobalRev(r)
+	var ch <-chan Update
+	if fromRev > 0 {
+		ch = db.Watch(path, fromRev)
+	} else {
+		ch = db.Subscribe(path)
+	}
 	defer db.Unsubscribe(ch)
 	for {
 		select {
-		case v := <-ch:
-			_, err := fmt.Fprintf(w, "data:%s\nid:%s:%d\n\n", v.Value, v.Key, v.Revision)
+		case v, ok := <-ch:
+			if !ok {
+				return // prefix was reserved out from under us
+			}
+			_, err := fmt.Fprintf(w, "data:%s\nid:%s:%d:%d\n\n", v.Value, v.Key, v.Revision, v.GlobalRev)
 			if err != nil {
 				return
 			}
@@ -170,19 +476,49 @@ func (h *handler) events(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// lastEventGlobalRev determines where a reconnecting SSE client should
+// resume from, preferring the browser-supplied Last-Event-ID (formatted
+// "key:revision:globalrev", as written by events) and falling back to an
+// explicit "?since=<globalrev>" query parameter.
+func lastEventGlobalRev(r *http.Request) int64 {
+	id := r.Header.Get("Last-Event-ID")
+	if id == "" {
+		id = r.URL.Query().Get("since")
+	}
+	if id == "" {
+		return 0
+	}
+	parts := strings.Split(id, ":")
+	rev, err := strconv.ParseInt(parts[len(parts)-1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return rev
+}
+
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	hdr := w.Header()
 	hdr.Set("Access-Control-Allow-Headers", "*")
 	hdr.Set("Access-Control-Allow-Methods", "*")
 	hdr.Set("Access-Control-Allow-Origin", "*")
 	hdr.Set("Access-Control-Expose-Headers", "X-Revision")
-	if r.URL.Path == "/" {
+	switch {
+	case strings.EqualFold(r.Header.Get("Upgrade"), "websocket"):
+		// Checked ahead of the "/" shortcut below: the JS client's
+		// connect() opens its WebSocket against the root path, so a
+		// path-only routing order would never see the upgrade.
+		h.ws(w, r)
+	case r.URL.Path == "/":
 		script(w, r)
-	} else {
+	case r.URL.Path == "/_stats" && r.Method == "GET":
+		h.stats(w, r)
+	case strings.HasPrefix(r.URL.Path, reservePrefix+"/") && r.Method == "POST":
+		h.reserve(w, r)
+	default:
 		switch r.Method {
 		case "GET":
-			switch r.Header.Get("Accept") {
-			case "text/event-stream":
+			switch {
+			case r.Header.Get("Accept") == "text/event-stream":
 				h.events(w, r)
 			default:
 				h.get(w, r)
@@ -191,21 +527,78 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			h.post(w, r)
 		case "PUT":
 			h.put(w, r)
+		case "PATCH":
+			h.patch(w, r)
+		case "DELETE":
+			h.delete(w, r)
 		case "OPTIONS":
 			log.Printf("OPTIONS %s", r.RemoteAddr)
 		}
 	}
 }
 
+func parseFsyncPolicy(s string) FsyncPolicy {
+	switch s {
+	case "every":
+		return FsyncEvery
+	case "none":
+		return FsyncNone
+	default:
+		return FsyncInterval
+	}
+}
+
 func main() {
 	addr := flag.String("addr", ":8000", "Server's host address")
+	data := flag.String("data", "", "Path prefix for on-disk persistence (disabled if empty)")
+	fsync := flag.String("fsync", "interval", "Log fsync policy: none, interval, or every")
+	auth := flag.String("auth", "", "Path to an ACL config file (disabled, trusting every request, if empty)")
+	rateRead := flag.String("rate-read", "100/s", "Per-IP read rate limit")
+	rateWrite := flag.String("rate-write", "10/s", "Per-IP and per-key write rate limit")
+	rateSub := flag.String("rate-sub", "1/s", "Per-IP subscribe rate limit")
+	maxSubsPerIP := flag.Int("max-subs-per-ip", 32, "Maximum concurrent SSE connections per IP")
+	maxSubsPerPath := flag.Int("max-subs-per-path", 256, "Maximum concurrent SSE connections per subscription path")
+	rateOverrides := flag.String("rate-overrides", "", "Path to a JSON file of per-prefix write rate overrides (optional)")
 	flag.Parse()
 
-	db := NewDatabase(0, 0)
+	var authz Authorizer = allowAll{}
+	if *auth != "" {
+		a, err := LoadFileAuthorizer(*auth)
+		if err != nil {
+			log.Fatalf("loading -auth config: %v", err)
+		}
+		authz = a
+	}
+
+	readRate, err := parseRate(*rateRead)
+	if err != nil {
+		log.Fatalf("-rate-read: %v", err)
+	}
+	writeRate, err := parseRate(*rateWrite)
+	if err != nil {
+		log.Fatalf("-rate-write: %v", err)
+	}
+	subRate, err := parseRate(*rateSub)
+	if err != nil {
+		log.Fatalf("-rate-sub: %v", err)
+	}
+	var overrides []keyRateOverride
+	if *rateOverrides != "" {
+		overrides, err = LoadKeyRateOverrides(*rateOverrides)
+		if err != nil {
+			log.Fatalf("loading -rate-overrides: %v", err)
+		}
+	}
+	limiter, err := NewRateLimiter(readRate, writeRate, subRate, *maxSubsPerIP, *maxSubsPerPath, overrides)
+	if err != nil {
+		log.Fatalf("configuring rate limits: %v", err)
+	}
+
+	db := NewDatabase(0, 0, 0, *data, parseFsyncPolicy(*fsync))
 	ctx := db.NewContext(context.Background())
 	s := &http.Server{
 		Addr:        *addr,
-		Handler:     &handler{},
+		Handler:     &handler{authz: authz, limiter: limiter},
 		BaseContext: func(l net.Listener) context.Context { return ctx },
 	}
 	log.Printf("listening at %s", *addr)
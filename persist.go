@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// FsyncPolicy controls how aggressively the append-only log is flushed to
+// stable storage.
+type FsyncPolicy int
+
+const (
+	FsyncNone     FsyncPolicy = iota // rely on the OS to flush eventually
+	FsyncInterval                    // fsync on a fixed tick (see fsyncInterval)
+	FsyncEvery                       // fsync after every appended record
+)
+
+const (
+	snapshotInterval = 5 * time.Minute // how often to snapshot and compact
+	fsyncInterval    = time.Second     // tick rate for FsyncInterval
+	maxLogSize       = 4 << 20         // compact once the log grows past this
+)
+
+type logOp string
+
+const (
+	opSet    logOp = "set"
+	opUpdate logOp = "update"
+	opDelete logOp = "delete"
+	opTTL    logOp = "ttl" // SetTTL changing a key's TTL without its value
+)
+
+// logRecord is one line of the append-only log. Time is the UnixNano
+// timestamp of the mutation, used on replay to reschedule a key's expiry
+// timer for however much of its TTL is left rather than a full d.expiry.
+// TTL carries the key's current TTL override (0 if none) on every op
+// except delete, whose records leave it 0.
+type logRecord struct {
+	Op       logOp  `json:"op"`
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+	Revision int    `json:"revision"`
+	TTL      int64  `json:"ttl,omitempty"`
+	Time     int64  `json:"time"`
+}
+
+func snapshotFile(path string) string     { return path + ".snapshot" }
+func logFilePath(path string) string      { return path + ".log" }
+func reservationsFile(path string) string { return path + ".reservations.json" }
+
+// openPersistence loads the newest snapshot, replays the log written since
+// that snapshot, and leaves the log open for append. It must run before
+// the dispatch goroutine starts, since it writes d.values directly.
+func (d *Database) openPersistence(path string, fsync FsyncPolicy) error {
+	d.persistPath = path
+	d.fsyncPolicy = fsync
+
+	if f, err := os.Open(snapshotFile(path)); err == nil {
+		var snap map[string]RangeEntry
+		decErr := json.NewDecoder(f).Decode(&snap)
+		f.Close()
+		if decErr != nil {
+			return fmt.Errorf("atomkv: reading snapshot: %w", decErr)
+		}
+		// Fall back to the snapshot file's mtime only for entries from
+		// a pre-Written snapshot; a real Written always beats it,
+		// since the file's mtime reflects the last compaction, not
+		// any individual key's last write.
+		var snapTime time.Time
+		if info, err := os.Stat(snapshotFile(path)); err == nil {
+			snapTime = info.ModTime()
+		}
+		for key, e := range snap {
+			written := snapTime
+			if e.Written != 0 {
+				written = time.Unix(0, e.Written)
+			}
+			d.values[key] = entry{value: e.Value, revision: e.Revision, ttl: e.TTL, written: written}
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("atomkv: opening snapshot: %w", err)
+	}
+
+	if f, err := os.Open(logFilePath(path)); err == nil {
+		replayErr := replayLog(f, d.values)
+		f.Close()
+		if replayErr != nil {
+			return fmt.Errorf("atomkv: replaying log: %w", replayErr)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("atomkv: opening log: %w", err)
+	}
+
+	if buf, err := os.ReadFile(reservationsFile(path)); err == nil {
+		if err := json.Unmarshal(buf, &d.reservations); err != nil {
+			return fmt.Errorf("atomkv: reading reservations: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("atomkv: opening reservations: %w", err)
+	}
+
+	logFile, err := os.OpenFile(logFilePath(path), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("atomkv: opening log for append: %w", err)
+	}
+	if fi, err := logFile.Stat(); err == nil {
+		d.logSize = fi.Size()
+	}
+	d.logFile = logFile
+
+	now := time.Now()
+	for key, e := range d.values {
+		go d.expireAfter(key, d.armDuration(e.ttl)-now.Sub(e.written))
+	}
+
+	go d.runTicker(snapshotInterval, d.chCompact)
+	if fsync == FsyncInterval {
+		go d.runTicker(fsyncInterval, d.chFsync)
+	}
+	return nil
+}
+
+// replayLog applies every record in r to values.
+func replayLog(r io.Reader, values map[string]entry) error {
+	dec := json.NewDecoder(r)
+	for {
+		var rec logRecord
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		switch rec.Op {
+		case opSet, opUpdate:
+			e := values[rec.Key]
+			e.value = rec.Value
+			e.revision = rec.Revision
+			e.ttl = time.Duration(rec.TTL)
+			e.written = time.Unix(0, rec.Time)
+			values[rec.Key] = e
+		case opTTL:
+			e := values[rec.Key]
+			e.ttl = time.Duration(rec.TTL)
+			e.written = time.Unix(0, rec.Time)
+			values[rec.Key] = e
+		case opDelete:
+			delete(values, rec.Key)
+		}
+	}
+}
+
+// runTicker sends on ch at the given period until the database stops. It
+// backs both the periodic snapshot/compaction and the FsyncInterval policy.
+func (d *Database) runTicker(period time.Duration, ch chan<- struct{}) {
+	t := time.NewTicker(period)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			select {
+			case ch <- struct{}{}:
+			case <-d.chStop:
+				return
+			}
+		case <-d.chStop:
+			return
+		}
+	}
+}
+
+// appendLog writes rec to the log if persistence is enabled, applying the
+// configured FsyncPolicy and triggering compaction once the log grows past
+// maxLogSize. Called from within dispatch so log order matches revisions.
+func (d *Database) appendLog(rec logRecord) {
+	if d.logFile == nil {
+		return
+	}
+
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("atomkv: marshal log record: %v", err)
+		return
+	}
+	buf = append(buf, '\n')
+
+	n, err := d.logFile.Write(buf)
+	if err != nil {
+		log.Printf("atomkv: append log: %v", err)
+		return
+	}
+	d.logSize += int64(n)
+
+	if d.fsyncPolicy == FsyncEvery {
+		d.logFile.Sync()
+	}
+	if d.logSize > maxLogSize {
+		d.compact()
+	}
+}
+
+// compact writes a fresh snapshot of the current state and truncates the
+// log, since every mutation up to this point is now captured in the
+// snapshot. Called from within dispatch.
+func (d *Database) compact() {
+	if d.logFile == nil {
+		return
+	}
+
+	snap := make(map[string]RangeEntry, len(d.values))
+	for key, e := range d.values {
+		snap[key] = RangeEntry{Value: e.value, Revision: e.revision, TTL: e.ttl, Written: e.written.UnixNano()}
+	}
+
+	tmp := snapshotFile(d.persistPath) + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Printf("atomkv: snapshot: %v", err)
+		return
+	}
+	if err := json.NewEncoder(f).Encode(snap); err != nil {
+		f.Close()
+		log.Printf("atomkv: snapshot: %v", err)
+		return
+	}
+	if err := f.Close(); err != nil {
+		log.Printf("atomkv: snapshot: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, snapshotFile(d.persistPath)); err != nil {
+		log.Printf("atomkv: snapshot: %v", err)
+		return
+	}
+
+	if err := d.logFile.Truncate(0); err != nil {
+		log.Printf("atomkv: log compaction: %v", err)
+		return
+	}
+	if _, err := d.logFile.Seek(0, io.SeekStart); err != nil {
+		log.Printf("atomkv: log compaction: %v", err)
+		return
+	}
+	d.logSize = 0
+}
+
+// persistReservations writes the current reservation table to disk so a
+// restarted database doesn't lose who holds exclusive write access to
+// which prefixes. A no-op when persistence is disabled.
+func (d *Database) persistReservations() {
+	if d.persistPath == "" {
+		return
+	}
+	buf, err := json.Marshal(d.reservations)
+	if err != nil {
+		log.Printf("atomkv: marshal reservations: %v", err)
+		return
+	}
+	if err := os.WriteFile(reservationsFile(d.persistPath), buf, 0644); err != nil {
+		log.Printf("atomkv: writing reservations: %v", err)
+	}
+}
+
+// Snapshot writes the database's current state as JSON to w. Unlike the
+// on-disk snapshot used for persistence, this is a point-in-time dump any
+// caller can request.
+func (d *Database) Snapshot(w io.Writer) error {
+	return json.NewEncoder(w).Encode(d.Range(""))
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rate is a "N per duration" throughput, as parsed from flags like "10/s".
+type rate struct {
+	n   float64
+	per time.Duration
+}
+
+func (r rate) perSecond() float64 {
+	if r.per == 0 {
+		return 0
+	}
+	return r.n / r.per.Seconds()
+}
+
+// parseRate parses strings like "10/s", "1/m", or "30/h". A bare number
+// with no "/unit" suffix is taken as per-second.
+func parseRate(s string) (rate, error) {
+	n, unit := s, "s"
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		n, unit = s[:i], s[i+1:]
+	}
+	f, err := strconv.ParseFloat(n, 64)
+	if err != nil {
+		return rate{}, fmt.Errorf("invalid rate %q: %w", s, err)
+	}
+	var per time.Duration
+	switch unit {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return rate{}, fmt.Errorf("invalid rate %q: unknown unit %q", s, unit)
+	}
+	return rate{n: f, per: per}, nil
+}
+
+// bucket is a token-bucket limiter: tokens refill continuously at rate per
+// second up to cap, and each Allow call costs one token.
+type bucket struct {
+	mu     sync.Mutex
+	tokens float64
+	cap    float64
+	rate   float64
+	last   time.Time
+}
+
+func newBucket(ratePerSecond float64) *bucket {
+	cap := ratePerSecond
+	if cap < 1 {
+		cap = 1
+	}
+	return &bucket{tokens: cap, cap: cap, rate: ratePerSecond, last: time.Now()}
+}
+
+// Allow reports whether a request may proceed, and if not, how long the
+// caller should wait before retrying.
+func (b *bucket) Allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.cap {
+		b.tokens = b.cap
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if b.rate <= 0 {
+		return false, time.Second
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// limiterSet hands out one bucket per key (typically a client IP or a
+// database key), creating it on first use. Buckets are otherwise never
+// evicted, which is fine for the modest, long-lived set of IPs this store
+// expects; callers keyed by arbitrary client-supplied values (database
+// keys) should sweep idle buckets themselves via sweep.
+type limiterSet struct {
+	mu      sync.Mutex
+	rate    float64
+	buckets map[string]*bucket
+}
+
+func newLimiterSet(ratePerSecond float64) *limiterSet {
+	return &limiterSet{rate: ratePerSecond, buckets: make(map[string]*bucket)}
+}
+
+func (l *limiterSet) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newBucket(l.rate)
+		l.buckets[key] = b
+	}
+	l.mu.Unlock()
+	return b.Allow()
+}
+
+// sweep drops every bucket that hasn't been used in longer than idle, so
+// a client can't grow this set without bound simply by writing to a
+// stream of distinct keys it never reuses.
+func (l *limiterSet) sweep(idle time.Duration) {
+	cutoff := time.Now().Add(-idle)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		b.mu.Lock()
+		stale := b.last.Before(cutoff)
+		b.mu.Unlock()
+		if stale {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// keyRateOverride applies a different write rate to keys under Prefix,
+// e.g. to clamp down harder on a known-hot key than the global default.
+type keyRateOverride struct {
+	Prefix string `json:"prefix"`
+	Rate   string `json:"rate"`
+}
+
+// RateLimiter enforces per-IP token buckets for reads, writes, and
+// subscribes, a per-key write bucket, and caps on concurrent SSE
+// connections per IP and per subscription path.
+type RateLimiter struct {
+	readByIP   *limiterSet
+	writeByIP  *limiterSet
+	subByIP    *limiterSet
+	writeByKey *limiterSet
+	overrides  []struct {
+		prefix  string
+		limiter *limiterSet
+	}
+
+	maxSubsPerIP   int
+	maxSubsPerPath int
+
+	mu         sync.Mutex
+	subsByIP   map[string]int
+	subsByPath map[string]int
+}
+
+// NewRateLimiter builds a RateLimiter from the given global rates and
+// subscription caps. keyOverrides may be nil.
+func NewRateLimiter(readRate, writeRate, subRate rate, maxSubsPerIP, maxSubsPerPath int, keyOverrides []keyRateOverride) (*RateLimiter, error) {
+	rl := &RateLimiter{
+		readByIP:       newLimiterSet(readRate.perSecond()),
+		writeByIP:      newLimiterSet(writeRate.perSecond()),
+		subByIP:        newLimiterSet(subRate.perSecond()),
+		writeByKey:     newLimiterSet(writeRate.perSecond()),
+		maxSubsPerIP:   maxSubsPerIP,
+		maxSubsPerPath: maxSubsPerPath,
+		subsByIP:       make(map[string]int),
+		subsByPath:     make(map[string]int),
+	}
+	for _, o := range keyOverrides {
+		r, err := parseRate(o.Rate)
+		if err != nil {
+			return nil, err
+		}
+		rl.overrides = append(rl.overrides, struct {
+			prefix  string
+			limiter *limiterSet
+		}{o.Prefix, newLimiterSet(r.perSecond())})
+	}
+	go rl.sweepKeyBuckets()
+	return rl, nil
+}
+
+const (
+	keyBucketIdleTimeout   = 10 * time.Minute
+	keyBucketSweepInterval = 5 * time.Minute
+)
+
+// sweepKeyBuckets periodically evicts idle per-key write buckets, for
+// writeByKey and every per-prefix override alike: unlike the per-IP sets,
+// these are keyed by arbitrary client-supplied database keys, so without
+// eviction a client could grow them without bound just by writing to a
+// stream of keys it never repeats.
+func (rl *RateLimiter) sweepKeyBuckets() {
+	t := time.NewTicker(keyBucketSweepInterval)
+	defer t.Stop()
+	for range t.C {
+		rl.writeByKey.sweep(keyBucketIdleTimeout)
+		for _, o := range rl.overrides {
+			o.limiter.sweep(keyBucketIdleTimeout)
+		}
+	}
+}
+
+// LoadKeyRateOverrides reads a JSON array of keyRateOverride from path.
+func LoadKeyRateOverrides(path string) ([]keyRateOverride, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var overrides []keyRateOverride
+	if err := json.Unmarshal(buf, &overrides); err != nil {
+		return nil, err
+	}
+	return overrides, nil
+}
+
+func (rl *RateLimiter) writeLimiterFor(key string) *limiterSet {
+	for _, o := range rl.overrides {
+		if strings.HasPrefix(key, o.prefix) {
+			return o.limiter
+		}
+	}
+	return rl.writeByKey
+}
+
+// AllowRead checks the per-IP read bucket.
+func (rl *RateLimiter) AllowRead(ip string) (bool, time.Duration) {
+	return rl.readByIP.Allow(ip)
+}
+
+// AllowWrite checks both the per-IP write bucket and the per-key write
+// bucket (or its override), so one hot key can't starve the rest.
+func (rl *RateLimiter) AllowWrite(ip, key string) (bool, time.Duration) {
+	if ok, wait := rl.writeByIP.Allow(ip); !ok {
+		return false, wait
+	}
+	return rl.writeLimiterFor(key).Allow(key)
+}
+
+// AcquireSubscribe checks the per-IP subscribe rate and both concurrency
+// caps, reserving a slot on success. Call ReleaseSubscribe when the SSE
+// connection ends.
+func (rl *RateLimiter) AcquireSubscribe(ip, path string) (bool, time.Duration) {
+	if ok, wait := rl.subByIP.Allow(ip); !ok {
+		return false, wait
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.subsByIP[ip] >= rl.maxSubsPerIP || rl.subsByPath[path] >= rl.maxSubsPerPath {
+		return false, 0
+	}
+	rl.subsByIP[ip]++
+	rl.subsByPath[path]++
+	return true, 0
+}
+
+// ReleaseSubscribe frees the concurrency slot claimed by AcquireSubscribe.
+func (rl *RateLimiter) ReleaseSubscribe(ip, path string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.subsByIP[ip]--
+	if rl.subsByIP[ip] <= 0 {
+		delete(rl.subsByIP, ip)
+	}
+	rl.subsByPath[path]--
+	if rl.subsByPath[path] <= 0 {
+		delete(rl.subsByPath, path)
+	}
+}
+
+// Stats is the JSON shape served at /_stats.
+type Stats struct {
+	ActiveSubscriptions int            `json:"active_subscriptions"`
+	SubscriptionsByIP   map[string]int `json:"subscriptions_by_ip"`
+	SubscriptionsByPath map[string]int `json:"subscriptions_by_path"`
+}
+
+func (rl *RateLimiter) Stats() Stats {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	stats := Stats{
+		SubscriptionsByIP:   make(map[string]int, len(rl.subsByIP)),
+		SubscriptionsByPath: make(map[string]int, len(rl.subsByPath)),
+	}
+	for ip, n := range rl.subsByIP {
+		stats.SubscriptionsByIP[ip] = n
+		stats.ActiveSubscriptions += n
+	}
+	for path, n := range rl.subsByPath {
+		stats.SubscriptionsByPath[path] = n
+	}
+	return stats
+}
@@ -20,7 +20,8 @@ let AtomKV = {
 					resolve([undefined, -1])
 				} else {
 					let revision = Number(xhr.getResponseHeader('X-Revision'))
-					resolve([JSON.parse(xhr.responseText), revision])
+					let expiresAt = xhr.getResponseHeader('X-Expires-At')
+					resolve([JSON.parse(xhr.responseText), revision, expiresAt])
 				}
 			}
 			xhr.onerror = function() {
@@ -31,7 +32,10 @@ let AtomKV = {
 		})
 	},
 
-	set: function(key, value) {
+	// set writes value to key. ttl is an optional number of seconds (or
+	// null for "never expires"); omit it to leave the key's current TTL
+	// (or the server default, for a new key) untouched.
+	set: function(key, value, ttl) {
 		let url = this.BASE + key
 		return new Promise(function(resolve, reject) {
 			let xhr = new XMLHttpRequest()
@@ -42,11 +46,14 @@ let AtomKV = {
 				reject(xhr.responseText)
 			}
 			xhr.open('POST', url, true)
+			if (ttl !== undefined) {
+				xhr.setRequestHeader('X-TTL', ttl === null ? 'never' : String(ttl))
+			}
 			xhr.send(JSON.stringify(value))
 		})
 	},
 
-	update: function(key, value, revision) {
+	update: function(key, value, revision, ttl) {
 		let url = this.BASE + key
 		return new Promise(function(resolve, reject) {
 			let xhr = new XMLHttpRequest()
@@ -58,10 +65,72 @@ let AtomKV = {
 			}
 			xhr.open('PUT', url, true)
 			xhr.setRequestHeader('X-Revision', String(revision))
+			if (ttl !== undefined) {
+				xhr.setRequestHeader('X-TTL', ttl === null ? 'never' : String(ttl))
+			}
 			xhr.send(JSON.stringify(value))
 		})
 	},
 
+	// touch extends, shortens, or pins key's TTL (seconds, or null for
+	// "never") without touching its value or revision — e.g. a
+	// presence key's heartbeat. Resolves false if key doesn't exist.
+	touch: function(key, ttl) {
+		let url = this.BASE + key
+		return new Promise(function(resolve, reject) {
+			let xhr = new XMLHttpRequest()
+			xhr.onload = function() {
+				resolve(xhr.status == 200)
+			}
+			xhr.onerror = function() {
+				reject(xhr.responseText)
+			}
+			xhr.open('PATCH', url, true)
+			xhr.setRequestHeader('X-TTL', ttl === null ? 'never' : String(ttl))
+			xhr.send()
+		})
+	},
+
+	del: function(key, revision) {
+		let url = this.BASE + key
+		return new Promise(function(resolve, reject) {
+			let xhr = new XMLHttpRequest()
+			xhr.onload = function() {
+				if (xhr.status == 409) {
+					resolve(false)
+				} else {
+					resolve(true)
+				}
+			}
+			xhr.onerror = function() {
+				reject(xhr.responseText)
+			}
+			xhr.open('DELETE', url, true)
+			if (revision !== undefined) {
+				xhr.setRequestHeader('X-Revision', String(revision))
+			}
+			xhr.send()
+		})
+	},
+
+	list: function(prefix) {
+		if (!prefix.endsWith('/')) {
+			prefix += '/'
+		}
+		let url = this.BASE + prefix
+		return new Promise(function(resolve, reject) {
+			let xhr = new XMLHttpRequest()
+			xhr.onload = function() {
+				resolve(JSON.parse(xhr.responseText))
+			}
+			xhr.onerror = function() {
+				reject(xhr.responseText)
+			}
+			xhr.open('GET', url, true)
+			xhr.send()
+		})
+	},
+
 	subscribe: async function*(keypath) {
 		let resolve = null
 		let promise = null
@@ -83,6 +152,92 @@ let AtomKV = {
 		} finally {
 			sse.close()
 		}
+	},
+
+	// connect opens a single WebSocket multiplexing any number of gets,
+	// sets, updates, and subscriptions, for callers who'd rather not burn
+	// a connection per EventSource (browsers cap those at six per origin).
+	connect: function() {
+		let ws = new WebSocket(this.BASE.replace(/^http/, 'ws') + '/')
+		let nextID = 1
+		let pending = new Map()
+		let subs = new Map()
+		let opened = new Promise(function(resolve) { ws.onopen = resolve })
+
+		function call(req) {
+			return opened.then(function() {
+				return new Promise(function(resolve, reject) {
+					let id = String(nextID++)
+					req.id = id
+					pending.set(id, {resolve: resolve, reject: reject})
+					ws.send(JSON.stringify(req))
+				})
+			})
+		}
+
+		ws.onmessage = function(event) {
+			let msg = JSON.parse(event.data)
+			if (msg.type == 'update') {
+				for (let [path, sub] of subs) {
+					if (path == msg.key || (path.endsWith('/') && msg.key.startsWith(path))) {
+						sub.resolve([msg.key, msg.value, msg.revision])
+						sub.reset()
+					}
+				}
+				return
+			}
+			let p = pending.get(msg.id)
+			if (!p) {
+				return
+			}
+			pending.delete(msg.id)
+			if (msg.type == 'error') {
+				p.reject(msg.error)
+			} else {
+				p.resolve(msg)
+			}
+		}
+
+		return {
+			get: function(key) {
+				return call({op: 'get', key: key}).then(function(msg) {
+					return [msg.value, msg.revision]
+				})
+			},
+
+			set: function(key, value) {
+				return call({op: 'set', key: key, value: value})
+			},
+
+			update: function(key, value, revision) {
+				return call({op: 'update', key: key, value: value, revision: revision}).then(
+					function() { return true },
+					function() { return false })
+			},
+
+			subscribe: async function*(path) {
+				let resolve = null
+				let promise = null
+				function reset() {
+					promise = new Promise(function(r) {resolve = r})
+				}
+				reset()
+				subs.set(path, {resolve: function(v) {resolve(v)}, reset: reset})
+				await call({op: 'sub', path: path})
+				try {
+					for (;;) {
+						yield await promise
+					}
+				} finally {
+					subs.delete(path)
+					call({op: 'unsub', path: path})
+				}
+			},
+
+			close: function() {
+				ws.close()
+			}
+		}
 	}
 }`)
 }
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWSFrameLength caps a single frame's payload. This protocol only ever
+// exchanges small JSON commands, so there's no reason to trust a frame's
+// claimed length past that; without a cap, the length==127 case reads an
+// 8-byte attacker-controlled size (up to ~2^63) and allocates a buffer of
+// that size before a single payload byte arrives.
+const maxWSFrameLength = 64 << 10 // 64 KiB
+
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+)
+
+// wsAccept computes the Sec-WebSocket-Accept value for a given
+// Sec-WebSocket-Key, per RFC 6455 section 1.3.
+func wsAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key)
+	io.WriteString(h, wsGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// wsUpgrade hijacks the connection and completes the WebSocket handshake,
+// returning the raw connection and its buffered reader/writer.
+func wsUpgrade(w http.ResponseWriter, r *http.Request) (net.Conn, *bufio.ReadWriter, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return nil, nil, errors.New("not a websocket upgrade")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, nil, errors.New("missing Sec-WebSocket-Key")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking unsupported")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n"
+	if _, err := rw.WriteString(resp); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, rw, nil
+}
+
+// wsReadFrame reads one WebSocket frame from r. It doesn't support
+// fragmented messages, which is fine for the small, single-frame JSON
+// commands this protocol exchanges.
+func wsReadFrame(r *bufio.Reader) (opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode = head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	length := int64(head[1] & 0x7f)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = int64(ext[0])<<8 | int64(ext[1])
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = 0
+		for _, b := range ext {
+			length = length<<8 | int64(b)
+		}
+	}
+
+	if length < 0 || length > maxWSFrameLength {
+		return 0, nil, errors.New("frame too large")
+	}
+
+	var maskKey [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, maskKey[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= maskKey[i%4]
+		}
+	}
+	return opcode, payload, nil
+}
+
+// wsWriteFrame writes one unmasked server-to-client frame, as required by
+// RFC 6455 (only client frames are masked).
+func wsWriteFrame(w io.Writer, opcode byte, payload []byte) error {
+	header := make([]byte, 0, 10)
+	header = append(header, 0x80|opcode) // fin=1
+	n := len(payload)
+	switch {
+	case n <= 125:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = append(header, 126, byte(n>>8), byte(n))
+	default:
+		b := byte(127)
+		header = append(header, b, 0, 0, 0, 0, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// wsRequest is one JSON command frame sent by the client.
+type wsRequest struct {
+	ID       string          `json:"id,omitempty"`
+	Op       string          `json:"op"`
+	Path     string          `json:"path,omitempty"`
+	Key      string          `json:"key,omitempty"`
+	Value    json.RawMessage `json:"value,omitempty"`
+	Revision int             `json:"revision,omitempty"`
+}
+
+// wsReply is sent back for every request (correlated by ID) and for every
+// update pushed to an active subscription (type "update", no ID).
+type wsReply struct {
+	Type     string          `json:"type"`
+	ID       string          `json:"id,omitempty"`
+	Key      string          `json:"key,omitempty"`
+	Value    json.RawMessage `json:"value,omitempty"`
+	Revision int             `json:"revision,omitempty"`
+	OK       bool            `json:"ok,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// wsSub tracks one active subscription so unsub can tear it down cleanly.
+type wsSub struct {
+	ch   <-chan Update
+	stop chan struct{}
+}
+
+// wsSession multiplexes multiple Database subscriptions and commands over
+// a single WebSocket connection, so a browser isn't limited to the ~6
+// concurrent-connections-per-origin cap EventSource runs into.
+type wsSession struct {
+	h    *handler
+	db   *Database
+	ip   string
+	conn net.Conn
+	rw   *bufio.ReadWriter
+
+	writeMu sync.Mutex
+
+	subsMu sync.Mutex
+	subs   map[string]wsSub
+
+	relay chan wsReply
+	done  chan struct{}
+}
+
+func (h *handler) ws(w http.ResponseWriter, r *http.Request) {
+	conn, rw, err := wsUpgrade(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	db, _ := FromContext(r.Context())
+	s := &wsSession{
+		h:     h,
+		db:    db,
+		ip:    clientIP(r),
+		conn:  conn,
+		rw:    rw,
+		subs:  make(map[string]wsSub),
+		relay: make(chan wsReply, 64),
+		done:  make(chan struct{}),
+	}
+	log.Printf("WS %s connect", s.ip)
+	s.run(r)
+}
+
+func (s *wsSession) writeJSON(v wsReply) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := wsWriteFrame(s.rw.Writer, wsOpText, buf); err != nil {
+		return
+	}
+	s.rw.Flush()
+}
+
+func (s *wsSession) run(r *http.Request) {
+	defer s.close()
+
+	go s.pushLoop()
+
+	for {
+		opcode, payload, err := wsReadFrame(s.rw.Reader)
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case wsOpClose:
+			s.writeMu.Lock()
+			wsWriteFrame(s.rw.Writer, wsOpClose, nil)
+			s.rw.Flush()
+			s.writeMu.Unlock()
+			return
+		case wsOpPing:
+			s.writeMu.Lock()
+			wsWriteFrame(s.rw.Writer, wsOpPong, payload)
+			s.rw.Flush()
+			s.writeMu.Unlock()
+		case wsOpText:
+			var req wsRequest
+			if err := json.Unmarshal(payload, &req); err != nil {
+				s.writeJSON(wsReply{Type: "error", Error: "invalid JSON"})
+				continue
+			}
+			s.handle(r, req)
+		}
+	}
+}
+
+// pushLoop relays buffered Update notifications from every active
+// subscription to the client as "update" frames.
+func (s *wsSession) pushLoop() {
+	for {
+		select {
+		case rep := <-s.relay:
+			s.writeJSON(rep)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *wsSession) handle(r *http.Request, req wsRequest) {
+	switch req.Op {
+	case "sub":
+		s.handleSub(r, req)
+	case "unsub":
+		s.handleUnsub(req)
+	case "get":
+		s.handleGet(r, req)
+	case "set":
+		s.handleSet(r, req)
+	case "update":
+		s.handleUpdate(r, req)
+	default:
+		s.writeJSON(wsReply{Type: "error", ID: req.ID, Error: "unknown op"})
+	}
+}
+
+func (s *wsSession) handleSub(r *http.Request, req wsRequest) {
+	if !validPath(req.Path) {
+		s.writeJSON(wsReply{Type: "error", ID: req.ID, Error: "invalid path"})
+		return
+	}
+	if _, ok := s.h.authz.Authorize(r, OpSubscribe, req.Path); !ok {
+		s.writeJSON(wsReply{Type: "error", ID: req.ID, Error: "forbidden"})
+		return
+	}
+	if ok, _ := s.h.limiter.AcquireSubscribe(s.ip, req.Path); !ok {
+		s.writeJSON(wsReply{Type: "error", ID: req.ID, Error: "rate limit exceeded"})
+		return
+	}
+
+	ch := s.db.Subscribe(req.Path)
+	stop := make(chan struct{})
+
+	s.subsMu.Lock()
+	if old, exists := s.subs[req.Path]; exists {
+		s.db.Unsubscribe(old.ch)
+		close(old.stop)
+		s.h.limiter.ReleaseSubscribe(s.ip, req.Path)
+	}
+	s.subs[req.Path] = wsSub{ch: ch, stop: stop}
+	s.subsMu.Unlock()
+
+	go s.forward(req.Path, ch, stop)
+	s.writeJSON(wsReply{Type: "ack", ID: req.ID, OK: true})
+}
+
+// forward copies Update notifications for one subscription into the
+// session's shared relay channel, until ch closes, stop fires (unsub), or
+// the session ends. If ch closes out from under us (e.g. the path's
+// prefix got reserved), the client is told its subscription ended and the
+// session's bookkeeping is cleaned up the same way an explicit unsub
+// would, so neither s.subs nor the limiter's concurrency slot leaks.
+func (s *wsSession) forward(path string, ch <-chan Update, stop chan struct{}) {
+	for {
+		select {
+		case u, ok := <-ch:
+			if !ok {
+				s.subsMu.Lock()
+				if sub, exists := s.subs[path]; exists && sub.ch == ch {
+					delete(s.subs, path)
+				}
+				s.subsMu.Unlock()
+				s.h.limiter.ReleaseSubscribe(s.ip, path)
+				s.writeJSON(wsReply{Type: "error", Key: path, Error: "subscription terminated"})
+				return
+			}
+			rep := wsReply{Type: "update", Key: u.Key, Value: json.RawMessage(u.Value), Revision: u.Revision}
+			select {
+			case s.relay <- rep:
+			case <-stop:
+				return
+			case <-s.done:
+				return
+			}
+		case <-stop:
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *wsSession) handleUnsub(req wsRequest) {
+	s.subsMu.Lock()
+	sub, ok := s.subs[req.Path]
+	delete(s.subs, req.Path)
+	s.subsMu.Unlock()
+
+	if !ok {
+		s.writeJSON(wsReply{Type: "error", ID: req.ID, Error: "not subscribed"})
+		return
+	}
+	s.db.Unsubscribe(sub.ch)
+	close(sub.stop)
+	s.h.limiter.ReleaseSubscribe(s.ip, req.Path)
+	s.writeJSON(wsReply{Type: "ack", ID: req.ID, OK: true})
+}
+
+func (s *wsSession) handleGet(r *http.Request, req wsRequest) {
+	if !validKey(req.Key) {
+		s.writeJSON(wsReply{Type: "error", ID: req.ID, Error: "invalid key"})
+		return
+	}
+	if _, ok := s.h.authz.Authorize(r, OpRead, req.Key); !ok {
+		s.writeJSON(wsReply{Type: "error", ID: req.ID, Error: "forbidden"})
+		return
+	}
+	if ok, _ := s.h.limiter.AllowRead(s.ip); !ok {
+		s.writeJSON(wsReply{Type: "error", ID: req.ID, Error: "rate limit exceeded"})
+		return
+	}
+
+	value, revision, ok := s.db.Get(req.Key)
+	if !ok {
+		s.writeJSON(wsReply{Type: "error", ID: req.ID, Error: "no such key"})
+		return
+	}
+	s.writeJSON(wsReply{Type: "value", ID: req.ID, Key: req.Key, Value: json.RawMessage(value), Revision: revision, OK: true})
+}
+
+func (s *wsSession) handleSet(r *http.Request, req wsRequest) {
+	if !validKey(req.Key) {
+		s.writeJSON(wsReply{Type: "error", ID: req.ID, Error: "invalid key"})
+		return
+	}
+	identity, ok := s.h.authz.Authorize(r, OpWrite, req.Key)
+	if !ok {
+		s.writeJSON(wsReply{Type: "error", ID: req.ID, Error: "forbidden"})
+		return
+	}
+	if ok, _ := s.h.limiter.AllowWrite(s.ip, req.Key); !ok {
+		s.writeJSON(wsReply{Type: "error", ID: req.ID, Error: "rate limit exceeded"})
+		return
+	}
+	if owner := s.db.ReservationOwner(req.Key); owner != "" && owner != identity {
+		s.writeJSON(wsReply{Type: "error", ID: req.ID, Error: "prefix reserved"})
+		return
+	}
+
+	value, ok := normalize(strings.NewReader(string(req.Value)))
+	if !ok {
+		s.writeJSON(wsReply{Type: "error", ID: req.ID, Error: "invalid JSON"})
+		return
+	}
+	s.db.Set(req.Key, value)
+	s.writeJSON(wsReply{Type: "ack", ID: req.ID, OK: true})
+}
+
+func (s *wsSession) handleUpdate(r *http.Request, req wsRequest) {
+	if !validKey(req.Key) {
+		s.writeJSON(wsReply{Type: "error", ID: req.ID, Error: "invalid key"})
+		return
+	}
+	identity, ok := s.h.authz.Authorize(r, OpWrite, req.Key)
+	if !ok {
+		s.writeJSON(wsReply{Type: "error", ID: req.ID, Error: "forbidden"})
+		return
+	}
+	if ok, _ := s.h.limiter.AllowWrite(s.ip, req.Key); !ok {
+		s.writeJSON(wsReply{Type: "error", ID: req.ID, Error: "rate limit exceeded"})
+		return
+	}
+	if owner := s.db.ReservationOwner(req.Key); owner != "" && owner != identity {
+		s.writeJSON(wsReply{Type: "error", ID: req.ID, Error: "prefix reserved"})
+		return
+	}
+
+	value, ok := normalize(strings.NewReader(string(req.Value)))
+	if !ok {
+		s.writeJSON(wsReply{Type: "error", ID: req.ID, Error: "invalid JSON"})
+		return
+	}
+	if !s.db.Update(req.Key, value, req.Revision) {
+		s.writeJSON(wsReply{Type: "error", ID: req.ID, Error: "revision conflict"})
+		return
+	}
+	s.writeJSON(wsReply{Type: "ack", ID: req.ID, OK: true})
+}
+
+func (s *wsSession) close() {
+	close(s.done)
+
+	s.subsMu.Lock()
+	for path, sub := range s.subs {
+		s.db.Unsubscribe(sub.ch)
+		close(sub.stop)
+		s.h.limiter.ReleaseSubscribe(s.ip, path)
+	}
+	s.subs = nil
+	s.subsMu.Unlock()
+
+	s.conn.Close()
+	log.Printf("WS %s disconnect", s.ip)
+}